@@ -0,0 +1,50 @@
+package contractcourt
+
+import (
+	"github.com/btcsuite/btcd/wire"
+	"github.com/lightningnetwork/lnd/lnwallet"
+)
+
+// ChainArbitratorConfig is the set of dependencies that are shared by all
+// channel arbitrators managed by the chain arbitrator. Each ChannelArbitrator
+// embeds a copy of this configuration so it can interact with the rest of
+// the daemon without needing to be aware of the concrete implementations
+// used.
+type ChainArbitratorConfig struct {
+	// PublishTx reliably broadcasts a transaction to the network. Once
+	// this function returns a nil error, the caller can assume that the
+	// transaction has been delivered to the network.
+	PublishTx func(*wire.MsgTx) error
+
+	// FeeEstimator is used to determine the fee rate that should be used
+	// to get a transaction confirmed within a desired number of blocks.
+	// It backs the anchor CPFP logic in the ChannelArbitrator, which
+	// relies on it to pick a fee rate steep enough to meet an HTLC's
+	// CLTV deadline.
+	FeeEstimator FeeEstimator
+
+	// HeightSource is used to learn the height of the best known block.
+	// The ChannelArbitrator queries it once on startup to seed its view
+	// of the chain, keeping it in sync afterwards purely from the
+	// BlockEpochs stream, so that its height-driven decisions can be
+	// exercised in tests without a full BlockChainIO implementation.
+	HeightSource HeightSource
+}
+
+// HeightSource is the minimal interface the ChannelArbitrator needs in order
+// to learn the height of the best known block.
+type HeightSource interface {
+	// CurrentHeight returns the height of the best known block.
+	CurrentHeight() (uint32, error)
+}
+
+// FeeEstimator is the minimal interface the ChannelArbitrator needs in order
+// to choose a fee rate for transactions it broadcasts itself, such as an
+// anchor CPFP sweep. It's implemented by the daemon's chain fee backend, but
+// kept as an interface here so it can be swapped out easily in tests.
+type FeeEstimator interface {
+	// EstimateFeePerKW returns a fee rate, expressed in satoshis per
+	// kilo-weight, that should be used in order to confirm a transaction
+	// within confTarget blocks.
+	EstimateFeePerKW(confTarget uint32) (lnwallet.SatPerKWeight, error)
+}
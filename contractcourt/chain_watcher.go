@@ -0,0 +1,50 @@
+package contractcourt
+
+import (
+	"github.com/lightningnetwork/lnd/chainntnfs"
+	"github.com/lightningnetwork/lnd/channeldb"
+	"github.com/lightningnetwork/lnd/lnwallet"
+)
+
+// LocalUnilateralCloseInfo encapsulates all the information we need to act
+// on a local force close that's been confirmed on chain.
+type LocalUnilateralCloseInfo struct {
+	*chainntnfs.SpendDetail
+	*lnwallet.LocalForceCloseSummary
+
+	// ChannelCloseSummary is the close summary that should be written to
+	// disk in response to this force closure.
+	ChannelCloseSummary *channeldb.ChannelCloseSummary
+}
+
+// CooperativeCloseInfo encapsulates all the information we need to act on a
+// cooperative channel closure that's been confirmed on chain.
+type CooperativeCloseInfo struct {
+	// ChannelCloseSummary is the close summary that should be written to
+	// disk in response to this co-op closure.
+	*channeldb.ChannelCloseSummary
+}
+
+// ChainEventSubscription is a subscription that's used to notify a caller of
+// any on-chain events related to a channel. The subscription is aware of all
+// the possible ways a channel can be closed, and will notify the caller
+// accordingly.
+type ChainEventSubscription struct {
+	// RemoteUnilateralClosure is a channel that will be sent upon in the
+	// event that the remote party's commitment transaction is confirmed
+	// on chain.
+	RemoteUnilateralClosure chan *lnwallet.UnilateralCloseSummary
+
+	// LocalUnilateralClosure is a channel that will be sent upon in the
+	// event that our own commitment transaction is confirmed on chain.
+	LocalUnilateralClosure chan *LocalUnilateralCloseInfo
+
+	// CooperativeClosure is a channel that will be sent upon in the
+	// event that the channel is closed cooperatively.
+	CooperativeClosure chan *CooperativeCloseInfo
+
+	// ContractBreach is a channel that will be sent upon if we detect a
+	// contract breach. The struct sent across the channel contains all
+	// the data necessary to bring justice to the cheating remote party.
+	ContractBreach chan *lnwallet.BreachRetribution
+}
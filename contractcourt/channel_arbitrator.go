@@ -0,0 +1,625 @@
+package contractcourt
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/lightningnetwork/lnd/chainntnfs"
+	"github.com/lightningnetwork/lnd/channeldb"
+	"github.com/lightningnetwork/lnd/lnwallet"
+	"github.com/lightningnetwork/lnd/lnwire"
+)
+
+// forceCloseReq is a request sent to the ChannelArbitrator to instruct it to
+// force close the channel it's watching over.
+type forceCloseReq struct {
+	// errResp is a channel that will be sent upon the error (if any)
+	// that occurred when attempting to broadcast the force close
+	// transaction.
+	errResp chan error
+
+	// closeTx is a channel that the broadcast force close transaction
+	// will be sent over, once available.
+	closeTx chan *wire.MsgTx
+}
+
+// ChannelArbitratorConfig holds the set of dependencies that a
+// ChannelArbitrator needs to carry out its duties.
+type ChannelArbitratorConfig struct {
+	// ChanPoint is the channel point that uniquely identifies this
+	// particular channel.
+	ChanPoint wire.OutPoint
+
+	// ShortChanID is the short channel ID of the channel under watch.
+	ShortChanID lnwire.ShortChannelID
+
+	// BlockEpochs is an active block epoch event stream backed by an
+	// active ChainNotifier instance. The ChannelArbitrator uses this to
+	// track the current height, bumping any pending anchor sweep and
+	// checking outstanding HTLC's for expiry on each new block.
+	BlockEpochs *chainntnfs.BlockEpochEvent
+
+	// MarkChannelResolved is a function closure that the
+	// ChannelArbitrator will invoke once the channel is fully resolved.
+	MarkChannelResolved func() error
+
+	// ForceCloseChan is a method that should be called when the
+	// ChannelArbitrator needs to force close the contract by broadcasting
+	// the current commitment transaction.
+	ForceCloseChan func() (*lnwallet.LocalForceCloseSummary, error)
+
+	// MarkCommitmentBroadcasted should mark the channel as the
+	// commitment transaction being broadcast, and we are waiting for the
+	// commitment to confirm.
+	MarkCommitmentBroadcasted func() error
+
+	// MarkChannelClosed marks the channel closed in the database,
+	// recording the final state of the channel.
+	MarkChannelClosed func(*channeldb.ChannelCloseSummary) error
+
+	// ChainArbitratorConfig houses a set of dependencies that are shared
+	// by all channel arbitrators managed by the chain arbitrator.
+	ChainArbitratorConfig
+
+	// ChainEvents is an active subscription to the set of relevant
+	// on-chain events related to this channel.
+	ChainEvents *ChainEventSubscription
+
+	// HasAnchor indicates whether the channel's commitment transactions
+	// pay to a local anchor output. When true, the ChannelArbitrator
+	// will attempt to CPFP our own commitment via the anchor once it's
+	// broadcast, so that it confirms in time to claim any outstanding
+	// HTLC's.
+	HasAnchor bool
+
+	// SweepAnchor broadcasts a child-pays-for-parent transaction that
+	// spends the local anchor output at the given fee rate, returning
+	// the resulting sweep transaction. It is called repeatedly, once per
+	// block, for as long as the commitment remains unconfirmed, so that
+	// the fee rate can be bumped as the deadline approaches.
+	SweepAnchor func(feeRate lnwallet.SatPerKWeight) (*wire.MsgTx, error)
+
+	// PreimageAvailable reports whether we already know the preimage for
+	// the passed payment hash, and so would be able to claim an incoming
+	// HTLC using it if we went to chain.
+	PreimageAvailable func(rHash [32]byte) bool
+
+	// BroadcastDelta is the number of blocks, prior to an HTLC's expiry
+	// height, at which the ChannelArbitrator will proactively force
+	// close the channel rather than wait for a fresh chain event, so
+	// that it has enough time to claim or time out the HTLC on-chain.
+	BroadcastDelta uint32
+}
+
+// ChannelArbitrator is the on-chain "brain" of a channel. Once a channel has
+// been detected as closing, the ChannelArbitrator will step through a series
+// of states, driving the resolution of the channel's outputs along the way.
+type ChannelArbitrator struct {
+	started int32 // To be used atomically.
+	stopped int32 // To be used atomically.
+
+	// state is the current state of the arbitrator. This state is
+	// examined upon start up to decide which actions to take.
+	state ArbitratorState
+
+	// log is the persistent log that the arbitrator will use to log its
+	// state, as well as any relevant resolutions/actions.
+	log ArbitratorLog
+
+	// activeResolvers is the set of resolvers that are currently active,
+	// and are attempting to resolve the set of pending contracts.
+	activeResolvers     []ContractResolver
+	activeResolversLock sync.RWMutex
+
+	// cfg contains all the functionality that the ChannelArbitrator
+	// requires to do its job.
+	cfg ChannelArbitratorConfig
+
+	// pendingHTLCs is the set of HTLC's that were outstanding on the
+	// local commitment at the time the arbitrator was created. It's used
+	// to derive the deadline for the anchor CPFP sweep.
+	pendingHTLCs []channeldb.HTLC
+
+	// anchorSweepTx is the most recently broadcast anchor CPFP sweep
+	// transaction, if any. It's nil whenever we're not in
+	// StateAnchorSweepPending.
+	anchorSweepTx *wire.MsgTx
+
+	// currentHeight is the height of the best known block, as reported
+	// by cfg.HeightSource on startup and kept current from the
+	// BlockEpochs stream afterwards. It's only ever touched from the
+	// channelAttendant goroutine.
+	currentHeight uint32
+
+	// forceCloseReqs is a channel that requests to forcibly close the
+	// contract will be sent over.
+	forceCloseReqs chan *forceCloseReq
+
+	wg   sync.WaitGroup
+	quit chan struct{}
+}
+
+// NewChannelArbitrator returns a new instance of a ChannelArbitrator backed
+// by the passed config struct.
+func NewChannelArbitrator(cfg ChannelArbitratorConfig,
+	pendingHTLCs []channeldb.HTLC, log ArbitratorLog) *ChannelArbitrator {
+
+	return &ChannelArbitrator{
+		log:            log,
+		cfg:            cfg,
+		pendingHTLCs:   pendingHTLCs,
+		forceCloseReqs: make(chan *forceCloseReq),
+		quit:           make(chan struct{}),
+	}
+}
+
+// Start starts all the goroutines that the ChannelArbitrator needs to operate.
+func (c *ChannelArbitrator) Start() error {
+	if !atomic.CompareAndSwapInt32(&c.started, 0, 1) {
+		return nil
+	}
+
+	state, err := c.log.CurrentState()
+	if err != nil {
+		return err
+	}
+	c.state = state
+
+	height, err := c.cfg.HeightSource.CurrentHeight()
+	if err != nil {
+		return fmt.Errorf("unable to get current height: %v", err)
+	}
+	c.currentHeight = height
+
+	// Before we enter the main loop, we'll check whether we crashed
+	// partway through handling a prior state, and if so, deterministically
+	// replay whatever side effects we might have missed.
+	if err := c.resumeContract(); err != nil {
+		return err
+	}
+
+	c.wg.Add(1)
+	go c.channelAttendant()
+
+	return nil
+}
+
+// resumeContract examines the state the arbitrator was left in prior to a
+// restart, and carries out whatever side effects are needed to pick back up
+// exactly where it left off, without waiting on a fresh chain event to
+// arrive.
+func (c *ChannelArbitrator) resumeContract() error {
+	switch c.state {
+
+	// We hadn't yet force closed before we went down. If, by the time
+	// we've come back up, an outstanding HTLC has already crossed its
+	// BroadcastDelta deadline, we force close immediately rather than
+	// wait on a BlockEpochs tick that may arrive too late.
+	case StateDefault:
+		if !c.htlcNearingExpiry(c.currentHeight) {
+			return nil
+		}
+
+		_, err := c.forceCloseContract()
+		return err
+
+	// We were in the process of force closing when we went down. As we
+	// don't know whether our commitment actually made it to the network,
+	// we'll simply attempt to re-broadcast it, driving the arbitrator
+	// through the exact same transitions (including scheduling an
+	// anchor sweep, if applicable) that it would have gone through had
+	// we not crashed.
+	case StateBroadcastCommit:
+		_, err := c.forceCloseContract()
+		return err
+
+	// Our own commitment was already broadcast before we went down. The
+	// chain watcher re-registers for the relevant spend notifications on
+	// every restart, so we don't need to do anything beyond waiting for
+	// it to redeliver the closure event. If our commitment pays to a
+	// local anchor, though, we still need to pick the CPFP sweep back up,
+	// since nothing else will drive us into StateAnchorSweepPending.
+	case StateCommitmentBroadcasted:
+		if !c.cfg.HasAnchor {
+			return nil
+		}
+
+		if err := c.advanceState(StateAnchorSweepPending, nil); err != nil {
+			return err
+		}
+
+		return c.bumpAnchorSweep()
+
+	// We were in the middle of CPFP'ing our own commitment via the
+	// anchor when we went down. We don't know whether our last sweep
+	// actually reached the network, and in any case the fee rate it was
+	// broadcast with may now be stale, so we immediately schedule a
+	// fresh one rather than waiting for the next block to arrive.
+	case StateAnchorSweepPending:
+		return c.bumpAnchorSweep()
+
+	// We'd already transitioned to closed, having logged the
+	// resolutions and chain actions derived from the closure, and may
+	// have extracted a set of resolvers for any outstanding contracts
+	// before going down. We confirm both were persisted, then re-launch
+	// the resolvers now, exactly as we would have had we not crashed.
+	case StateContractClosed:
+		if _, err := c.log.FetchContractResolutions(); err != nil {
+			return fmt.Errorf(
+				"unable to fetch contract resolutions: %v",
+				err,
+			)
+		}
+
+		if _, err := c.log.FetchChainActions(); err != nil {
+			return fmt.Errorf(
+				"unable to fetch chain actions: %v", err,
+			)
+		}
+
+		return c.relaunchResolvers()
+	}
+
+	return nil
+}
+
+// Stop signals the ChannelArbitrator for a graceful shutdown, and waits for
+// all goroutines to exit.
+func (c *ChannelArbitrator) Stop() error {
+	if !atomic.CompareAndSwapInt32(&c.stopped, 0, 1) {
+		return nil
+	}
+
+	close(c.quit)
+	c.wg.Wait()
+
+	return nil
+}
+
+// advanceState transitions the arbitrator to the passed state. If
+// sideEffects is non-nil, it's invoked with the same log transaction used to
+// commit the state, so that any additional writes (contract resolutions,
+// chain actions, unresolved contracts) are persisted atomically alongside
+// the transition itself. If either the state commit or the side effects
+// fail, the entire batch is rolled back and the arbitrator's in-memory state
+// is left untouched, so a subsequent restart resumes from the last state
+// that was actually committed.
+func (c *ChannelArbitrator) advanceState(state ArbitratorState,
+	sideEffects func(tx LogTx) error) error {
+
+	err := c.log.Update(func(tx LogTx) error {
+		if err := tx.CommitState(state); err != nil {
+			return err
+		}
+
+		if sideEffects == nil {
+			return nil
+		}
+
+		return sideEffects(tx)
+	})
+	if err != nil {
+		return fmt.Errorf("unable to commit state transition: %v", err)
+	}
+
+	c.state = state
+
+	return nil
+}
+
+// resolveContract drives the arbitrator through the terminal states once a
+// channel closing transaction (co-op or force close) has been detected and
+// confirmed on chain. Once all contracts (currently none beyond the direct
+// outputs) have been resolved, the channel is marked fully resolved.
+func (c *ChannelArbitrator) resolveContract(
+	closeSummary *channeldb.ChannelCloseSummary) error {
+
+	if err := c.cfg.MarkChannelClosed(closeSummary); err != nil {
+		return fmt.Errorf("unable to mark channel closed: %v", err)
+	}
+
+	resolutions := &ContractResolutions{
+		CommitHash: closeSummary.ClosingTXID,
+	}
+
+	// The transition to StateContractClosed and the logging of the
+	// resolutions it unlocks are persisted as a single atomic batch, so
+	// we can never end up having logged one without the other.
+	err := c.advanceState(
+		StateContractClosed,
+		func(tx LogTx) error {
+			return tx.LogContractResolutions(resolutions)
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	return c.relaunchResolvers()
+}
+
+// relaunchResolvers fetches the set of contract resolvers left unresolved
+// from a prior pass (whether that's the one that just ran, or one that was
+// interrupted by a restart), and records them as the arbitrator's active
+// resolvers. It doesn't call their Resolve methods. If none remain
+// outstanding, the channel is marked as fully resolved.
+func (c *ChannelArbitrator) relaunchResolvers() error {
+	resolvers, err := c.log.FetchUnresolvedContracts()
+	if err != nil {
+		return fmt.Errorf("unable to fetch unresolved contracts: %v", err)
+	}
+
+	c.activeResolversLock.Lock()
+	c.activeResolvers = resolvers
+	c.activeResolversLock.Unlock()
+
+	// TODO(roasbeef): actually launch each resolver's Resolve() method in
+	// its own goroutine, feeding swaps/resolutions back into the log as
+	// they complete, and wait on all of them before continuing on.
+	if len(resolvers) > 0 {
+		return nil
+	}
+
+	if err := c.advanceState(StateFullyResolved, nil); err != nil {
+		return err
+	}
+
+	return c.cfg.MarkChannelResolved()
+}
+
+// handleForceCloseReq processes a request to forcibly close the channel by
+// broadcasting our latest commitment transaction.
+func (c *ChannelArbitrator) handleForceCloseReq(req *forceCloseReq) {
+	closeTx, err := c.forceCloseContract()
+	if err != nil {
+		req.errResp <- err
+		return
+	}
+
+	req.closeTx <- closeTx
+	req.errResp <- nil
+}
+
+// forceCloseContract drives the arbitrator through broadcasting our latest
+// commitment transaction, whether that was triggered by a user-issued
+// forceCloseReq, or by the arbitrator itself deciding that an outstanding
+// HTLC needs to be resolved on-chain before it expires.
+func (c *ChannelArbitrator) forceCloseContract() (*wire.MsgTx, error) {
+	if err := c.advanceState(StateBroadcastCommit, nil); err != nil {
+		return nil, err
+	}
+
+	closeSummary, err := c.cfg.ForceCloseChan()
+	if err != nil {
+		return nil, fmt.Errorf("unable to force close: %v", err)
+	}
+
+	// We'll attempt to broadcast our commitment transaction. If the
+	// broadcast fails because the remote party beat us to it, we still
+	// consider the force close request a success, as we'll simply
+	// resolve the channel once their commitment confirms instead.
+	err = c.cfg.PublishTx(closeSummary.CloseTx)
+	if err != nil && err != lnwallet.ErrDoubleSpend {
+		return nil, fmt.Errorf("unable to broadcast close tx: %v", err)
+	}
+
+	if err := c.cfg.MarkCommitmentBroadcasted(); err != nil {
+		return nil, fmt.Errorf(
+			"unable to mark commitment broadcasted: %v", err,
+		)
+	}
+
+	if err := c.advanceState(StateCommitmentBroadcasted, nil); err != nil {
+		return nil, err
+	}
+
+	// If our commitment pays to a local anchor, we'll need to CPFP it via
+	// the anchor in case it doesn't confirm on its own, so we transition
+	// to a dedicated state to track that.
+	if c.cfg.HasAnchor {
+		if err := c.advanceState(StateAnchorSweepPending, nil); err != nil {
+			return nil, err
+		}
+
+		if err := c.bumpAnchorSweep(); err != nil {
+			return nil, fmt.Errorf("unable to sweep anchor: %v", err)
+		}
+	}
+
+	return closeSummary.CloseTx, nil
+}
+
+// htlcNearingExpiry reports whether any of the HTLC's outstanding on our
+// commitment will expire within BroadcastDelta blocks of the passed height,
+// and so should be resolved on-chain now rather than risk missing the
+// deadline waiting for a chain event. An outgoing HTLC needs this as soon as
+// its CLTV nears, so we can time it out before the remote party can claim
+// it with the preimage. An incoming HTLC only needs it if we already hold
+// the preimage, since otherwise there's nothing for us to claim.
+func (c *ChannelArbitrator) htlcNearingExpiry(height uint32) bool {
+	for _, htlc := range c.pendingHTLCs {
+		if htlc.Incoming && !c.cfg.PreimageAvailable(htlc.RHash) {
+			continue
+		}
+
+		if height+c.cfg.BroadcastDelta >= htlc.RefundTimeout {
+			return true
+		}
+	}
+
+	return false
+}
+
+// anchorConfTarget derives the confirmation target that should be used for
+// the anchor CPFP sweep, based on the nearest CLTV expiry among the HTLC's
+// that were outstanding when the channel was force closed. A small buffer is
+// subtracted so that the sweep has a chance to confirm before the HTLC
+// actually expires.
+func (c *ChannelArbitrator) anchorConfTarget(currentHeight uint32) uint32 {
+	const (
+		// defaultConfTarget is used when there are no outstanding
+		// HTLC's to derive a deadline from.
+		defaultConfTarget = 6
+
+		// deadlineBuffer is subtracted from the nearest CLTV to
+		// leave some room for the sweep to actually confirm.
+		deadlineBuffer = 3
+	)
+
+	var nearestCLTV uint32
+	for _, htlc := range c.pendingHTLCs {
+		if nearestCLTV == 0 || htlc.RefundTimeout < nearestCLTV {
+			nearestCLTV = htlc.RefundTimeout
+		}
+	}
+
+	if nearestCLTV == 0 {
+		return defaultConfTarget
+	}
+
+	if nearestCLTV <= currentHeight {
+		return 1
+	}
+
+	blocksToDeadline := nearestCLTV - currentHeight
+	if blocksToDeadline <= deadlineBuffer {
+		return 1
+	}
+
+	return blocksToDeadline - deadlineBuffer
+}
+
+// bumpAnchorSweep (re)broadcasts a CPFP transaction spending our anchor
+// output, using a fee rate derived from the FeeEstimator and the deadline
+// imposed by the nearest HTLC CLTV. It's called once when the anchor sweep
+// is first scheduled, and again on every subsequent block for as long as the
+// arbitrator remains in StateAnchorSweepPending.
+func (c *ChannelArbitrator) bumpAnchorSweep() error {
+	confTarget := c.anchorConfTarget(c.currentHeight)
+
+	feeRate, err := c.cfg.FeeEstimator.EstimateFeePerKW(confTarget)
+	if err != nil {
+		return fmt.Errorf("unable to estimate fee rate: %v", err)
+	}
+
+	sweepTx, err := c.cfg.SweepAnchor(feeRate)
+	if err != nil {
+		return fmt.Errorf("unable to sweep anchor: %v", err)
+	}
+
+	c.anchorSweepTx = sweepTx
+
+	return nil
+}
+
+// cancelAnchorSweep aborts any anchor CPFP sweep in progress. It's called
+// once a commitment, either our own or the remote party's, has confirmed,
+// making the anchor sweep unnecessary.
+func (c *ChannelArbitrator) cancelAnchorSweep() {
+	c.anchorSweepTx = nil
+}
+
+// channelAttendant is the primary goroutine for the ChannelArbitrator. It
+// waits for chain events, and force close requests, driving the contract
+// towards resolution as they arrive.
+func (c *ChannelArbitrator) channelAttendant() {
+	defer c.wg.Done()
+
+	for {
+		select {
+		// A new block has arrived, we'll use this to drive any
+		// height-based decisions we may need to make.
+		case epoch := <-c.cfg.BlockEpochs.Epochs:
+			c.currentHeight = uint32(epoch.Height)
+
+			switch c.state {
+			case StateAnchorSweepPending:
+				if err := c.bumpAnchorSweep(); err != nil {
+					log.Errorf("unable to bump anchor "+
+						"sweep for ChannelPoint(%v): %v",
+						c.cfg.ChanPoint, err)
+				}
+
+			// We haven't yet force closed, so check whether any
+			// outstanding HTLC is nearing its expiry, in which
+			// case we force close now rather than wait for a
+			// chain event that may never come in time.
+			case StateDefault:
+				if !c.htlcNearingExpiry(c.currentHeight) {
+					continue
+				}
+
+				if _, err := c.forceCloseContract(); err != nil {
+					log.Errorf("unable to force close "+
+						"ChannelPoint(%v) to resolve "+
+						"expiring HTLC: %v",
+						c.cfg.ChanPoint, err)
+				}
+			}
+
+		// We've been instructed to force close the channel under
+		// watch.
+		case req := <-c.forceCloseReqs:
+			c.handleForceCloseReq(req)
+
+		// The remote party has unilaterally closed the channel,
+		// broadcasting their version of the commitment transaction.
+		case uniClosure := <-c.cfg.ChainEvents.RemoteUnilateralClosure:
+			closeSummary := &channeldb.ChannelCloseSummary{
+				ChanPoint: c.cfg.ChanPoint,
+				CloseType: channeldb.RemoteForceClose,
+			}
+			if uniClosure.SpendDetail != nil {
+				closeSummary.ClosingTXID = *uniClosure.SpendDetail.SpenderTxHash
+			}
+
+			// The remote party's commitment confirmed instead of
+			// our own, so any anchor sweep we had in flight is no
+			// longer needed.
+			if c.state == StateAnchorSweepPending {
+				c.cancelAnchorSweep()
+			}
+
+			if err := c.resolveContract(closeSummary); err != nil {
+				log.Errorf("unable to resolve contract "+
+					"for ChannelPoint(%v): %v",
+					c.cfg.ChanPoint, err)
+			}
+
+		// We force closed the channel ourselves, and our own
+		// commitment transaction has now confirmed.
+		case localClosure := <-c.cfg.ChainEvents.LocalUnilateralClosure:
+			closeSummary := localClosure.ChannelCloseSummary
+			closeSummary.CloseType = channeldb.LocalForceClose
+
+			// Our commitment confirmed on its own, before the
+			// anchor sweep was needed.
+			if c.state == StateAnchorSweepPending {
+				c.cancelAnchorSweep()
+			}
+
+			if err := c.resolveContract(closeSummary); err != nil {
+				log.Errorf("unable to resolve contract "+
+					"for ChannelPoint(%v): %v",
+					c.cfg.ChanPoint, err)
+			}
+
+		// The channel has been cooperatively closed, with the
+		// closing transaction already confirmed.
+		case coopClosure := <-c.cfg.ChainEvents.CooperativeClosure:
+			closeSummary := coopClosure.ChannelCloseSummary
+			closeSummary.CloseType = channeldb.CooperativeClose
+
+			if err := c.resolveContract(closeSummary); err != nil {
+				log.Errorf("unable to resolve contract "+
+					"for ChannelPoint(%v): %v",
+					c.cfg.ChanPoint, err)
+			}
+
+		case <-c.quit:
+			return
+		}
+	}
+}
@@ -2,6 +2,7 @@ package contractcourt
 
 import (
 	"fmt"
+	"io"
 	"testing"
 	"time"
 
@@ -16,25 +17,55 @@ import (
 type mockArbitratorLog struct {
 	state     ArbitratorState
 	newStates chan ArbitratorState
+
+	// unresolvedContracts is returned by FetchUnresolvedContracts. It
+	// lets tests simulate a restart with resolvers still outstanding
+	// from a prior pass.
+	unresolvedContracts []ContractResolver
+
+	// failResolutionLog, when set, makes LogContractResolutions fail,
+	// simulating a batch that crashes midway through persisting a state
+	// transition alongside its side effects.
+	failResolutionLog bool
 }
 
 // A compile time check to ensure mockArbitratorLog meets the ArbitratorLog
 // interface.
 var _ ArbitratorLog = (*mockArbitratorLog)(nil)
 
+// A compile time check to ensure mockArbitratorLog meets the LogTx
+// interface, since it also acts as its own transaction.
+var _ LogTx = (*mockArbitratorLog)(nil)
+
 func (b *mockArbitratorLog) CurrentState() (ArbitratorState, error) {
 	return b.state, nil
 }
 
+// Update applies the update closure against the log's current state,
+// buffering any state transition until the closure returns successfully. If
+// the closure returns an error, the buffered state is discarded, leaving the
+// previously committed state untouched.
+func (b *mockArbitratorLog) Update(update func(tx LogTx) error) error {
+	prevState := b.state
+	if err := update(b); err != nil {
+		b.state = prevState
+		return err
+	}
+
+	if b.state != prevState {
+		b.newStates <- b.state
+	}
+
+	return nil
+}
+
 func (b *mockArbitratorLog) CommitState(s ArbitratorState) error {
 	b.state = s
-	b.newStates <- s
 	return nil
 }
 
 func (b *mockArbitratorLog) FetchUnresolvedContracts() ([]ContractResolver, error) {
-	var contracts []ContractResolver
-	return contracts, nil
+	return b.unresolvedContracts, nil
 }
 
 func (b *mockArbitratorLog) InsertUnresolvedContracts(resolvers ...ContractResolver) error {
@@ -50,6 +81,10 @@ func (b *mockArbitratorLog) ResolveContract(res ContractResolver) error {
 }
 
 func (b *mockArbitratorLog) LogContractResolutions(c *ContractResolutions) error {
+	if b.failResolutionLog {
+		return fmt.Errorf("simulated disk failure")
+	}
+
 	return nil
 }
 
@@ -72,28 +107,50 @@ func (b *mockArbitratorLog) WipeHistory() error {
 	return nil
 }
 
-type mockChainIO struct{}
+// mockHeightSource is a HeightSource that always reports a fixed height,
+// simulating the best known block at the time the arbitrator was started.
+type mockHeightSource struct {
+	height uint32
+}
+
+func (m *mockHeightSource) CurrentHeight() (uint32, error) {
+	return m.height, nil
+}
+
+// mockContractResolver is a bare-bones ContractResolver used to populate a
+// mockArbitratorLog's set of unresolved contracts.
+type mockContractResolver struct{}
+
+// A compile time check to ensure mockContractResolver meets the
+// ContractResolver interface.
+var _ ContractResolver = (*mockContractResolver)(nil)
+
+func (*mockContractResolver) ResolverKey() []byte {
+	return []byte("mock-resolver")
+}
 
-func (*mockChainIO) GetBestBlock() (*chainhash.Hash, int32, error) {
-	return nil, 0, nil
+func (m *mockContractResolver) Resolve() (ContractResolver, error) {
+	return m, nil
 }
 
-func (*mockChainIO) GetUtxo(op *wire.OutPoint, _ []byte,
-	heightHint uint32) (*wire.TxOut, error) {
-	return nil, nil
+func (*mockContractResolver) IsResolved() bool {
+	return false
 }
 
-func (*mockChainIO) GetBlockHash(blockHeight int64) (*chainhash.Hash, error) {
-	return nil, nil
+func (*mockContractResolver) Stop() {}
+
+func (*mockContractResolver) IsPending() bool {
+	return true
 }
 
-func (*mockChainIO) GetBlock(blockHash *chainhash.Hash) (*wire.MsgBlock, error) {
-	return nil, nil
+func (*mockContractResolver) Encode(w io.Writer) error {
+	return nil
 }
 
 func createTestChannelArbitrator(log ArbitratorLog) (*ChannelArbitrator,
 	chan struct{}, error) {
 	blockEpoch := &chainntnfs.BlockEpochEvent{
+		Epochs: make(chan *chainntnfs.BlockEpoch, 1),
 		Cancel: func() {},
 	}
 
@@ -106,12 +163,11 @@ func createTestChannelArbitrator(log ArbitratorLog) (*ChannelArbitrator,
 		ContractBreach:          make(chan *lnwallet.BreachRetribution, 1),
 	}
 
-	chainIO := &mockChainIO{}
 	chainArbCfg := ChainArbitratorConfig{
-		ChainIO: chainIO,
 		PublishTx: func(*wire.MsgTx) error {
 			return nil
 		},
+		HeightSource: &mockHeightSource{},
 	}
 
 	// We'll use the resolvedChan to synchronize on call to
@@ -141,6 +197,9 @@ func createTestChannelArbitrator(log ArbitratorLog) (*ChannelArbitrator,
 		MarkChannelClosed: func(*channeldb.ChannelCloseSummary) error {
 			return nil
 		},
+		PreimageAvailable: func([32]byte) bool {
+			return false
+		},
 		ChainArbitratorConfig: chainArbCfg,
 		ChainEvents:           chanEvents,
 	}
@@ -209,6 +268,15 @@ func TestChannelArbitratorCooperativeClose(t *testing.T) {
 	case <-time.After(5 * time.Second):
 		t.Fatalf("contract was not resolved")
 	}
+
+	// If persisting the resolutions this transition unlocks fails, the
+	// whole batch, including the transition itself, should be rolled
+	// back.
+	assertResolutionBatchRollback(t, func(chanArb *ChannelArbitrator) {
+		chanArb.cfg.ChainEvents.CooperativeClosure <- &CooperativeCloseInfo{
+			&channeldb.ChannelCloseSummary{},
+		}
+	})
 }
 
 func assertStateTransitions(t *testing.T, newStates <-chan ArbitratorState,
@@ -229,6 +297,65 @@ func assertStateTransitions(t *testing.T, newStates <-chan ArbitratorState,
 	}
 }
 
+// assertResolutionBatchRollback verifies that if persisting the contract
+// resolutions associated with a StateContractClosed transition fails, the
+// transition itself is rolled back, and a ChannelArbitrator that restarts
+// against the same log resumes from the state that was last actually
+// committed, rather than the one that failed to persist. trigger is used to
+// deliver whichever channel-closure event is appropriate for the scenario
+// under test.
+func assertResolutionBatchRollback(t *testing.T,
+	trigger func(chanArb *ChannelArbitrator)) {
+
+	t.Helper()
+
+	log := &mockArbitratorLog{
+		state:             StateDefault,
+		newStates:         make(chan ArbitratorState, 5),
+		failResolutionLog: true,
+	}
+
+	chanArb, resolved, err := createTestChannelArbitrator(log)
+	if err != nil {
+		t.Fatalf("unable to create ChannelArbitrator: %v", err)
+	}
+	if err := chanArb.Start(); err != nil {
+		t.Fatalf("unable to start ChannelArbitrator: %v", err)
+	}
+	defer chanArb.Stop()
+
+	trigger(chanArb)
+
+	// Since persisting the resolutions failed, the transition to
+	// StateContractClosed should never have been committed, nor should
+	// the channel have been marked resolved.
+	select {
+	case state := <-log.newStates:
+		t.Fatalf("unexpected state transition to %v despite failed "+
+			"batch", state)
+	case <-resolved:
+		t.Fatalf("contract marked resolved despite failed batch")
+	case <-time.After(time.Second):
+	}
+
+	assertState(t, chanArb, StateDefault)
+
+	// A ChannelArbitrator that restarts against the same log should
+	// therefore resume from StateDefault, the last state that was
+	// actually committed, rather than the one the failed batch
+	// attempted to advance to.
+	restartedArb, _, err := createTestChannelArbitrator(log)
+	if err != nil {
+		t.Fatalf("unable to create ChannelArbitrator: %v", err)
+	}
+	if err := restartedArb.Start(); err != nil {
+		t.Fatalf("unable to start ChannelArbitrator: %v", err)
+	}
+	defer restartedArb.Stop()
+
+	assertState(t, restartedArb, StateDefault)
+}
+
 // TestChannelArbitratorRemoteForceClose checks that the ChannelArbitrator goes
 // through the expected states if a remote force close is observed in the
 // chain.
@@ -275,6 +402,19 @@ func TestChannelArbitratorRemoteForceClose(t *testing.T) {
 	case <-time.After(5 * time.Second):
 		t.Fatalf("contract was not resolved")
 	}
+
+	// If persisting the resolutions this transition unlocks fails, the
+	// whole batch, including the transition itself, should be rolled
+	// back.
+	assertResolutionBatchRollback(t, func(chanArb *ChannelArbitrator) {
+		commitSpend := &chainntnfs.SpendDetail{
+			SpenderTxHash: &chainhash.Hash{},
+		}
+		chanArb.cfg.ChainEvents.RemoteUnilateralClosure <- &lnwallet.UnilateralCloseSummary{
+			SpendDetail:     commitSpend,
+			HtlcResolutions: &lnwallet.HtlcResolutions{},
+		}
+	})
 }
 
 // TestChannelArbitratorLocalForceClose tests that the ChannelArbitrator goes
@@ -381,6 +521,20 @@ func TestChannelArbitratorLocalForceClose(t *testing.T) {
 	case <-time.After(5 * time.Second):
 		t.Fatalf("contract was not resolved")
 	}
+
+	// If persisting the resolutions this transition unlocks fails, the
+	// whole batch, including the transition itself, should be rolled
+	// back.
+	assertResolutionBatchRollback(t, func(chanArb *ChannelArbitrator) {
+		chanArb.cfg.ChainEvents.LocalUnilateralClosure <- &LocalUnilateralCloseInfo{
+			&chainntnfs.SpendDetail{},
+			&lnwallet.LocalForceCloseSummary{
+				CloseTx:         &wire.MsgTx{},
+				HtlcResolutions: &lnwallet.HtlcResolutions{},
+			},
+			&channeldb.ChannelCloseSummary{},
+		}
+	})
 }
 
 // TestChannelArbitratorLocalForceCloseRemoteConfiremd tests that the
@@ -594,3 +748,730 @@ func TestChannelArbitratorLocalForceDoubleSpend(t *testing.T) {
 		t.Fatalf("contract was not resolved")
 	}
 }
+
+// TestChannelArbitratorRestartBroadcastCommit tests that a ChannelArbitrator
+// that starts up in StateBroadcastCommit (having crashed before it could
+// confirm its own commitment was actually propagated) re-broadcasts the
+// commitment transaction and advances to StateCommitmentBroadcasted, without
+// any fresh chain event or force close request triggering it.
+func TestChannelArbitratorRestartBroadcastCommit(t *testing.T) {
+	log := &mockArbitratorLog{
+		state:     StateBroadcastCommit,
+		newStates: make(chan ArbitratorState, 5),
+	}
+
+	chanArb, _, err := createTestChannelArbitrator(log)
+	if err != nil {
+		t.Fatalf("unable to create ChannelArbitrator: %v", err)
+	}
+
+	publishedChan := make(chan struct{}, 1)
+	chanArb.cfg.PublishTx = func(*wire.MsgTx) error {
+		publishedChan <- struct{}{}
+		return nil
+	}
+
+	if err := chanArb.Start(); err != nil {
+		t.Fatalf("unable to start ChannelArbitrator: %v", err)
+	}
+	defer chanArb.Stop()
+
+	select {
+	case <-publishedChan:
+		// Expected, the commitment was re-broadcast on startup.
+	case <-time.After(5 * time.Second):
+		t.Fatalf("commitment was not re-broadcast on restart")
+	}
+
+	assertStateTransitions(t, log.newStates, StateCommitmentBroadcasted)
+	assertState(t, chanArb, StateCommitmentBroadcasted)
+}
+
+// TestChannelArbitratorRestartBroadcastCommitAnchor tests that a
+// ChannelArbitrator restarting in StateBroadcastCommit on a channel with an
+// anchor output re-broadcasts the commitment and then picks the anchor CPFP
+// sweep back up, landing in StateAnchorSweepPending, without any fresh chain
+// event or force close request triggering it.
+func TestChannelArbitratorRestartBroadcastCommitAnchor(t *testing.T) {
+	log := &mockArbitratorLog{
+		state:     StateBroadcastCommit,
+		newStates: make(chan ArbitratorState, 5),
+	}
+
+	chanArb, _, err := createTestChannelArbitrator(log)
+	if err != nil {
+		t.Fatalf("unable to create ChannelArbitrator: %v", err)
+	}
+
+	publishedChan := make(chan struct{}, 1)
+	chanArb.cfg.PublishTx = func(*wire.MsgTx) error {
+		publishedChan <- struct{}{}
+		return nil
+	}
+
+	feeEstimator := &mockFeeEstimator{
+		feeRate:     lnwallet.SatPerKWeight(2500),
+		confTargets: make(chan uint32, 5),
+	}
+	chanArb.cfg.FeeEstimator = feeEstimator
+
+	sweepTxes := make(chan *wire.MsgTx, 5)
+	chanArb.cfg.HasAnchor = true
+	chanArb.cfg.SweepAnchor = func(
+		feeRate lnwallet.SatPerKWeight) (*wire.MsgTx, error) {
+
+		sweepTx := &wire.MsgTx{Version: int32(feeRate)}
+		sweepTxes <- sweepTx
+		return sweepTx, nil
+	}
+
+	if err := chanArb.Start(); err != nil {
+		t.Fatalf("unable to start ChannelArbitrator: %v", err)
+	}
+	defer chanArb.Stop()
+
+	select {
+	case <-publishedChan:
+		// Expected, the commitment was re-broadcast on startup.
+	case <-time.After(5 * time.Second):
+		t.Fatalf("commitment was not re-broadcast on restart")
+	}
+
+	assertStateTransitions(
+		t, log.newStates, StateCommitmentBroadcasted,
+		StateAnchorSweepPending,
+	)
+
+	select {
+	case <-sweepTxes:
+		// Expected, the anchor sweep was scheduled on startup.
+	case <-time.After(5 * time.Second):
+		t.Fatalf("anchor sweep was not broadcast on restart")
+	}
+
+	assertState(t, chanArb, StateAnchorSweepPending)
+}
+
+// TestChannelArbitratorRestartCommitmentBroadcasted tests that a
+// ChannelArbitrator that starts up in StateCommitmentBroadcasted on a channel
+// without an anchor simply waits for the chain watcher to redeliver the
+// closure event, rather than taking any further action on its own.
+func TestChannelArbitratorRestartCommitmentBroadcasted(t *testing.T) {
+	log := &mockArbitratorLog{
+		state:     StateCommitmentBroadcasted,
+		newStates: make(chan ArbitratorState, 5),
+	}
+
+	chanArb, _, err := createTestChannelArbitrator(log)
+	if err != nil {
+		t.Fatalf("unable to create ChannelArbitrator: %v", err)
+	}
+
+	if err := chanArb.Start(); err != nil {
+		t.Fatalf("unable to start ChannelArbitrator: %v", err)
+	}
+	defer chanArb.Stop()
+
+	// No state transition should have been triggered on startup.
+	select {
+	case state := <-log.newStates:
+		t.Fatalf("unexpected state transition to %v", state)
+	case <-time.After(time.Second):
+		// Expected, the arbitrator is simply waiting.
+	}
+
+	assertState(t, chanArb, StateCommitmentBroadcasted)
+}
+
+// TestChannelArbitratorRestartCommitmentBroadcastedAnchor tests that a
+// ChannelArbitrator that starts up in StateCommitmentBroadcasted on a channel
+// with an anchor output picks the CPFP sweep back up on its own, landing in
+// StateAnchorSweepPending, without any fresh chain event or force close
+// request triggering it.
+func TestChannelArbitratorRestartCommitmentBroadcastedAnchor(t *testing.T) {
+	log := &mockArbitratorLog{
+		state:     StateCommitmentBroadcasted,
+		newStates: make(chan ArbitratorState, 5),
+	}
+
+	chanArb, _, err := createTestChannelArbitrator(log)
+	if err != nil {
+		t.Fatalf("unable to create ChannelArbitrator: %v", err)
+	}
+
+	feeEstimator := &mockFeeEstimator{
+		feeRate:     lnwallet.SatPerKWeight(2500),
+		confTargets: make(chan uint32, 5),
+	}
+	chanArb.cfg.FeeEstimator = feeEstimator
+
+	sweepTxes := make(chan *wire.MsgTx, 5)
+	chanArb.cfg.HasAnchor = true
+	chanArb.cfg.SweepAnchor = func(
+		feeRate lnwallet.SatPerKWeight) (*wire.MsgTx, error) {
+
+		sweepTx := &wire.MsgTx{Version: int32(feeRate)}
+		sweepTxes <- sweepTx
+		return sweepTx, nil
+	}
+
+	if err := chanArb.Start(); err != nil {
+		t.Fatalf("unable to start ChannelArbitrator: %v", err)
+	}
+	defer chanArb.Stop()
+
+	assertStateTransitions(t, log.newStates, StateAnchorSweepPending)
+
+	select {
+	case <-feeEstimator.confTargets:
+		// Expected, the fee estimator was queried on startup.
+	case <-time.After(5 * time.Second):
+		t.Fatalf("fee estimator was not queried on restart")
+	}
+
+	select {
+	case <-sweepTxes:
+		// Expected, the anchor sweep was scheduled on startup.
+	case <-time.After(5 * time.Second):
+		t.Fatalf("anchor sweep was not broadcast on restart")
+	}
+
+	assertState(t, chanArb, StateAnchorSweepPending)
+}
+
+// TestChannelArbitratorRestartContractClosed tests that a ChannelArbitrator
+// that starts up in StateContractClosed re-launches its resolvers, and since
+// the mock log reports none outstanding, immediately marks the channel
+// resolved.
+func TestChannelArbitratorRestartContractClosed(t *testing.T) {
+	log := &mockArbitratorLog{
+		state:     StateContractClosed,
+		newStates: make(chan ArbitratorState, 5),
+	}
+
+	chanArb, resolved, err := createTestChannelArbitrator(log)
+	if err != nil {
+		t.Fatalf("unable to create ChannelArbitrator: %v", err)
+	}
+
+	if err := chanArb.Start(); err != nil {
+		t.Fatalf("unable to start ChannelArbitrator: %v", err)
+	}
+	defer chanArb.Stop()
+
+	assertStateTransitions(t, log.newStates, StateFullyResolved)
+
+	select {
+	case <-resolved:
+		// Expected.
+	case <-time.After(5 * time.Second):
+		t.Fatalf("contract was not resolved")
+	}
+
+	assertState(t, chanArb, StateFullyResolved)
+}
+
+// TestChannelArbitratorRestartContractClosedUnresolved tests that a
+// ChannelArbitrator that starts up in StateContractClosed re-launches
+// whatever resolvers the log reports as still outstanding, and does not mark
+// the channel resolved while any of them remain.
+func TestChannelArbitratorRestartContractClosedUnresolved(t *testing.T) {
+	log := &mockArbitratorLog{
+		state:               StateContractClosed,
+		newStates:           make(chan ArbitratorState, 5),
+		unresolvedContracts: []ContractResolver{&mockContractResolver{}},
+	}
+
+	chanArb, resolved, err := createTestChannelArbitrator(log)
+	if err != nil {
+		t.Fatalf("unable to create ChannelArbitrator: %v", err)
+	}
+
+	if err := chanArb.Start(); err != nil {
+		t.Fatalf("unable to start ChannelArbitrator: %v", err)
+	}
+	defer chanArb.Stop()
+
+	// Since a resolver is still outstanding, the arbitrator shouldn't
+	// advance past StateContractClosed, nor mark the channel resolved.
+	select {
+	case state := <-log.newStates:
+		t.Fatalf("unexpected state transition to %v", state)
+	case <-resolved:
+		t.Fatalf("contract marked resolved with resolvers outstanding")
+	case <-time.After(time.Second):
+	}
+
+	if len(chanArb.activeResolvers) != 1 {
+		t.Fatalf("expected 1 active resolver, got %v",
+			len(chanArb.activeResolvers))
+	}
+
+	assertState(t, chanArb, StateContractClosed)
+}
+
+// mockFeeEstimator is a FeeEstimator that always returns a fixed fee rate,
+// recording each confirmation target it was queried with.
+type mockFeeEstimator struct {
+	feeRate lnwallet.SatPerKWeight
+
+	confTargets chan uint32
+}
+
+func (m *mockFeeEstimator) EstimateFeePerKW(
+	confTarget uint32) (lnwallet.SatPerKWeight, error) {
+
+	m.confTargets <- confTarget
+	return m.feeRate, nil
+}
+
+// TestChannelArbitratorAnchorSweep tests that the ChannelArbitrator
+// transitions into StateAnchorSweepPending after broadcasting a local force
+// close on a channel with an anchor, fee-bumps the anchor sweep on every
+// subsequent block, and cancels the sweep if the commitment confirms before
+// it's needed.
+func TestChannelArbitratorAnchorSweep(t *testing.T) {
+	log := &mockArbitratorLog{
+		state:     StateDefault,
+		newStates: make(chan ArbitratorState, 5),
+	}
+
+	chanArb, resolved, err := createTestChannelArbitrator(log)
+	if err != nil {
+		t.Fatalf("unable to create ChannelArbitrator: %v", err)
+	}
+
+	feeEstimator := &mockFeeEstimator{
+		feeRate:     lnwallet.SatPerKWeight(2500),
+		confTargets: make(chan uint32, 5),
+	}
+	chanArb.cfg.FeeEstimator = feeEstimator
+
+	sweepTxes := make(chan *wire.MsgTx, 5)
+	chanArb.cfg.HasAnchor = true
+	chanArb.cfg.SweepAnchor = func(
+		feeRate lnwallet.SatPerKWeight) (*wire.MsgTx, error) {
+
+		sweepTx := &wire.MsgTx{Version: int32(feeRate)}
+		sweepTxes <- sweepTx
+		return sweepTx, nil
+	}
+
+	if err := chanArb.Start(); err != nil {
+		t.Fatalf("unable to start ChannelArbitrator: %v", err)
+	}
+	defer chanArb.Stop()
+
+	assertState(t, chanArb, StateDefault)
+
+	errChan := make(chan error, 1)
+	respChan := make(chan *wire.MsgTx, 1)
+	chanArb.forceCloseReqs <- &forceCloseReq{
+		errResp: errChan,
+		closeTx: respChan,
+	}
+
+	// It should transition StateBroadcastCommit ->
+	// StateCommitmentBroadcasted -> StateAnchorSweepPending, and along
+	// the way, schedule an initial anchor sweep.
+	assertStateTransitions(
+		t, log.newStates, StateBroadcastCommit,
+		StateCommitmentBroadcasted, StateAnchorSweepPending,
+	)
+
+	select {
+	case <-feeEstimator.confTargets:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("fee estimator was not queried")
+	}
+
+	select {
+	case <-sweepTxes:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("anchor sweep was not broadcast")
+	}
+
+	select {
+	case <-respChan:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no response received")
+	}
+	select {
+	case err := <-errChan:
+		if err != nil {
+			t.Fatalf("error force closing channel: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no response received")
+	}
+
+	assertState(t, chanArb, StateAnchorSweepPending)
+
+	// Deliver a handful of block epochs, each should result in a
+	// fee-bumped anchor sweep.
+	for i := 0; i < 3; i++ {
+		chanArb.cfg.BlockEpochs.Epochs <- &chainntnfs.BlockEpoch{}
+
+		select {
+		case <-feeEstimator.confTargets:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("fee estimator was not queried on block %d", i)
+		}
+
+		select {
+		case <-sweepTxes:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("anchor sweep was not re-broadcast on block %d", i)
+		}
+	}
+
+	// Now notify about our local force close confirming, before the
+	// anchor sweep was needed. The arbitrator should stop fee-bumping
+	// and resolve the channel as usual.
+	chanArb.cfg.ChainEvents.LocalUnilateralClosure <- &LocalUnilateralCloseInfo{
+		&chainntnfs.SpendDetail{},
+		&lnwallet.LocalForceCloseSummary{
+			CloseTx:         &wire.MsgTx{},
+			HtlcResolutions: &lnwallet.HtlcResolutions{},
+		},
+		&channeldb.ChannelCloseSummary{},
+	}
+
+	assertStateTransitions(
+		t, log.newStates, StateContractClosed, StateFullyResolved,
+	)
+
+	select {
+	case <-resolved:
+		// Expected.
+	case <-time.After(5 * time.Second):
+		t.Fatalf("contract was not resolved")
+	}
+
+	if chanArb.anchorSweepTx != nil {
+		t.Fatalf("expected anchor sweep to be cancelled")
+	}
+}
+
+// TestChannelArbitratorRestartAnchorSweepPending tests that a
+// ChannelArbitrator that starts up in StateAnchorSweepPending immediately
+// schedules a fresh anchor sweep, rather than waiting for the next
+// BlockEpochs tick to arrive.
+func TestChannelArbitratorRestartAnchorSweepPending(t *testing.T) {
+	log := &mockArbitratorLog{
+		state:     StateAnchorSweepPending,
+		newStates: make(chan ArbitratorState, 5),
+	}
+
+	chanArb, _, err := createTestChannelArbitrator(log)
+	if err != nil {
+		t.Fatalf("unable to create ChannelArbitrator: %v", err)
+	}
+
+	feeEstimator := &mockFeeEstimator{
+		feeRate:     lnwallet.SatPerKWeight(2500),
+		confTargets: make(chan uint32, 5),
+	}
+	chanArb.cfg.FeeEstimator = feeEstimator
+
+	sweepTxes := make(chan *wire.MsgTx, 5)
+	chanArb.cfg.HasAnchor = true
+	chanArb.cfg.SweepAnchor = func(
+		feeRate lnwallet.SatPerKWeight) (*wire.MsgTx, error) {
+
+		sweepTx := &wire.MsgTx{Version: int32(feeRate)}
+		sweepTxes <- sweepTx
+		return sweepTx, nil
+	}
+
+	if err := chanArb.Start(); err != nil {
+		t.Fatalf("unable to start ChannelArbitrator: %v", err)
+	}
+	defer chanArb.Stop()
+
+	select {
+	case <-feeEstimator.confTargets:
+		// Expected, the fee estimator was queried on startup.
+	case <-time.After(5 * time.Second):
+		t.Fatalf("fee estimator was not queried on restart")
+	}
+
+	select {
+	case <-sweepTxes:
+		// Expected, a fresh anchor sweep was broadcast on startup.
+	case <-time.After(5 * time.Second):
+		t.Fatalf("anchor sweep was not re-broadcast on restart")
+	}
+
+	assertState(t, chanArb, StateAnchorSweepPending)
+}
+
+// TestArbitratorLogUpdateAtomic tests that a batch of log writes applied via
+// ArbitratorLog.Update is all-or-nothing: if the closure passed to Update
+// fails partway through, none of the writes it performed (including any
+// state transition) are left persisted, so a ChannelArbitrator that resumes
+// from the log after a restart picks back up from the last state that was
+// actually committed.
+func TestArbitratorLogUpdateAtomic(t *testing.T) {
+	log := &mockArbitratorLog{
+		state:     StateCommitmentBroadcasted,
+		newStates: make(chan ArbitratorState, 5),
+	}
+
+	// Simulate a batch that successfully transitions the state, but then
+	// fails while persisting an associated side effect. The whole batch
+	// should be rolled back.
+	failErr := fmt.Errorf("simulated disk failure")
+	err := log.Update(func(tx LogTx) error {
+		if err := tx.CommitState(StateContractClosed); err != nil {
+			return err
+		}
+
+		return failErr
+	})
+	if err != failErr {
+		t.Fatalf("expected update to fail with %v, got: %v", failErr, err)
+	}
+
+	// Since the batch failed, the persisted state should be unchanged.
+	state, err := log.CurrentState()
+	if err != nil {
+		t.Fatalf("unable to fetch current state: %v", err)
+	}
+	if state != StateCommitmentBroadcasted {
+		t.Fatalf("expected state to remain %v after failed update, got %v",
+			StateCommitmentBroadcasted, state)
+	}
+
+	// A ChannelArbitrator created against this log, simulating a restart,
+	// should resume from the last successfully committed state, rather
+	// than the one that failed to commit.
+	chanArb, _, err := createTestChannelArbitrator(log)
+	if err != nil {
+		t.Fatalf("unable to create ChannelArbitrator: %v", err)
+	}
+	if err := chanArb.Start(); err != nil {
+		t.Fatalf("unable to start ChannelArbitrator: %v", err)
+	}
+	defer chanArb.Stop()
+
+	assertState(t, chanArb, StateCommitmentBroadcasted)
+}
+
+// TestChannelArbitratorHtlcTimeoutForceClose tests that the ChannelArbitrator
+// proactively force closes the channel, without any forceCloseReq or chain
+// event, once an outgoing HTLC on the commitment nears its CLTV expiry by
+// BroadcastDelta blocks.
+func TestChannelArbitratorHtlcTimeoutForceClose(t *testing.T) {
+	log := &mockArbitratorLog{
+		state:     StateDefault,
+		newStates: make(chan ArbitratorState, 5),
+	}
+
+	chanArb, _, err := createTestChannelArbitrator(log)
+	if err != nil {
+		t.Fatalf("unable to create ChannelArbitrator: %v", err)
+	}
+
+	const broadcastDelta = 5
+	const expiryHeight = 15
+
+	chanArb.cfg.BroadcastDelta = broadcastDelta
+	chanArb.pendingHTLCs = []channeldb.HTLC{
+		{
+			Incoming:      false,
+			RefundTimeout: expiryHeight,
+		},
+	}
+
+	publishedChan := make(chan struct{}, 1)
+	chanArb.cfg.PublishTx = func(*wire.MsgTx) error {
+		publishedChan <- struct{}{}
+		return nil
+	}
+
+	if err := chanArb.Start(); err != nil {
+		t.Fatalf("unable to start ChannelArbitrator: %v", err)
+	}
+	defer chanArb.Stop()
+
+	assertState(t, chanArb, StateDefault)
+
+	// Deliver block epochs up to, but not including, the height at which
+	// we should force close. None of these should trigger a transition.
+	for height := int32(1); height < expiryHeight-broadcastDelta; height++ {
+		chanArb.cfg.BlockEpochs.Epochs <- &chainntnfs.BlockEpoch{
+			Height: height,
+		}
+
+		select {
+		case state := <-log.newStates:
+			t.Fatalf("unexpected state transition to %v at "+
+				"height %v", state, height)
+		case <-publishedChan:
+			t.Fatalf("unexpected broadcast at height %v", height)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	assertState(t, chanArb, StateDefault)
+
+	// The next block brings us within BroadcastDelta of the HTLC's
+	// expiry, and should trigger a force close.
+	chanArb.cfg.BlockEpochs.Epochs <- &chainntnfs.BlockEpoch{
+		Height: expiryHeight - broadcastDelta,
+	}
+
+	assertStateTransitions(
+		t, log.newStates, StateBroadcastCommit,
+		StateCommitmentBroadcasted,
+	)
+
+	select {
+	case <-publishedChan:
+		// Expected, the commitment was broadcast to resolve the
+		// expiring HTLC on-chain.
+	case <-time.After(5 * time.Second):
+		t.Fatalf("commitment was not broadcast for expiring HTLC")
+	}
+
+	assertState(t, chanArb, StateCommitmentBroadcasted)
+}
+
+// TestChannelArbitratorHtlcPreimageForceClose tests that the
+// ChannelArbitrator only force closes to claim an incoming HTLC nearing
+// expiry if it actually has the preimage needed to claim it, since otherwise
+// there's nothing on-chain resolution could recover for us.
+func TestChannelArbitratorHtlcPreimageForceClose(t *testing.T) {
+	log := &mockArbitratorLog{
+		state:     StateDefault,
+		newStates: make(chan ArbitratorState, 5),
+	}
+
+	chanArb, _, err := createTestChannelArbitrator(log)
+	if err != nil {
+		t.Fatalf("unable to create ChannelArbitrator: %v", err)
+	}
+
+	const broadcastDelta = 5
+	const expiryHeight = 15
+
+	rHash := [32]byte{1, 2, 3}
+
+	chanArb.cfg.BroadcastDelta = broadcastDelta
+	chanArb.cfg.PreimageAvailable = func(hash [32]byte) bool {
+		return false
+	}
+	chanArb.pendingHTLCs = []channeldb.HTLC{
+		{
+			Incoming:      true,
+			RHash:         rHash,
+			RefundTimeout: expiryHeight,
+		},
+	}
+
+	publishedChan := make(chan struct{}, 1)
+	chanArb.cfg.PublishTx = func(*wire.MsgTx) error {
+		publishedChan <- struct{}{}
+		return nil
+	}
+
+	if err := chanArb.Start(); err != nil {
+		t.Fatalf("unable to start ChannelArbitrator: %v", err)
+	}
+	defer chanArb.Stop()
+
+	// Since we don't have the preimage, reaching the deadline height
+	// shouldn't trigger a force close.
+	chanArb.cfg.BlockEpochs.Epochs <- &chainntnfs.BlockEpoch{
+		Height: expiryHeight - broadcastDelta,
+	}
+
+	select {
+	case state := <-log.newStates:
+		t.Fatalf("unexpected state transition to %v", state)
+	case <-publishedChan:
+		t.Fatalf("unexpected broadcast without preimage")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	assertState(t, chanArb, StateDefault)
+
+	// Once we learn the preimage, the very next block at or past the
+	// deadline should trigger a force close.
+	chanArb.cfg.PreimageAvailable = func(hash [32]byte) bool {
+		return hash == rHash
+	}
+
+	chanArb.cfg.BlockEpochs.Epochs <- &chainntnfs.BlockEpoch{
+		Height: expiryHeight - broadcastDelta,
+	}
+
+	assertStateTransitions(
+		t, log.newStates, StateBroadcastCommit,
+		StateCommitmentBroadcasted,
+	)
+
+	select {
+	case <-publishedChan:
+		// Expected, the commitment was broadcast to claim the
+		// incoming HTLC now that we have the preimage.
+	case <-time.After(5 * time.Second):
+		t.Fatalf("commitment was not broadcast once preimage was known")
+	}
+}
+
+// TestChannelArbitratorRestartHtlcExpiry tests that a ChannelArbitrator that
+// starts up already past an outstanding HTLC's BroadcastDelta deadline force
+// closes immediately on startup, rather than waiting for the next
+// BlockEpochs tick to notice.
+func TestChannelArbitratorRestartHtlcExpiry(t *testing.T) {
+	log := &mockArbitratorLog{
+		state:     StateDefault,
+		newStates: make(chan ArbitratorState, 5),
+	}
+
+	chanArb, _, err := createTestChannelArbitrator(log)
+	if err != nil {
+		t.Fatalf("unable to create ChannelArbitrator: %v", err)
+	}
+
+	const broadcastDelta = 5
+	const expiryHeight = 15
+	const restartHeight = expiryHeight - broadcastDelta
+
+	chanArb.cfg.BroadcastDelta = broadcastDelta
+	chanArb.cfg.HeightSource = &mockHeightSource{height: restartHeight}
+	chanArb.pendingHTLCs = []channeldb.HTLC{
+		{
+			Incoming:      false,
+			RefundTimeout: expiryHeight,
+		},
+	}
+
+	publishedChan := make(chan struct{}, 1)
+	chanArb.cfg.PublishTx = func(*wire.MsgTx) error {
+		publishedChan <- struct{}{}
+		return nil
+	}
+
+	if err := chanArb.Start(); err != nil {
+		t.Fatalf("unable to start ChannelArbitrator: %v", err)
+	}
+	defer chanArb.Stop()
+
+	assertStateTransitions(
+		t, log.newStates, StateBroadcastCommit,
+		StateCommitmentBroadcasted,
+	)
+
+	select {
+	case <-publishedChan:
+		// Expected, the commitment was broadcast immediately on
+		// startup to resolve the already-expiring HTLC.
+	case <-time.After(5 * time.Second):
+		t.Fatalf("commitment was not broadcast on restart")
+	}
+
+	assertState(t, chanArb, StateCommitmentBroadcasted)
+}
@@ -0,0 +1,35 @@
+package contractcourt
+
+import "io"
+
+// ContractResolver is the minimal interface that a type of contract resolver
+// needs to implement in order to be handled by the ChannelArbitrator. The
+// ChannelArbitrator itself isn't aware of the details of any particular
+// contract resolution strategy, it merely drives each one towards
+// resolution, and persists the set of active resolvers across restarts.
+type ContractResolver interface {
+	// ResolverKey returns an identifier which should be globally unique
+	// for this particular contract.
+	ResolverKey() []byte
+
+	// Resolve instructs the contract resolver to resolve the output
+	// on-chain, and returns a new resolver that should be used in place
+	// of the old one, if the contract isn't yet fully resolved.
+	Resolve() (ContractResolver, error)
+
+	// IsResolved returns true if the stored state in the resolver has
+	// been fully resolved.
+	IsResolved() bool
+
+	// Stop signals the resolver to cancel any current resolution
+	// processes, and suspend.
+	Stop()
+
+	// IsPending returns true if the contract is still pending
+	// resolution. This is the opposite of IsResolved.
+	IsPending() bool
+
+	// Encode writes an encoded version of the ContractResolver into the
+	// passed Writer.
+	Encode(w io.Writer) error
+}
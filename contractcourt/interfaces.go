@@ -0,0 +1,202 @@
+package contractcourt
+
+import (
+	"errors"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/lightningnetwork/lnd/channeldb"
+	"github.com/lightningnetwork/lnd/lnwallet"
+)
+
+// ErrNoResolutions is returned when no contract resolutions are found.
+var ErrNoResolutions = errors.New("no contract resolutions exist")
+
+// ErrNoActions is returned when no chain actions are found.
+var ErrNoActions = errors.New("no chain actions exist")
+
+// ArbitratorState is the main state of the ChannelArbitrator. It is
+// persisted so the arbitrator is able to resume operation in the correct
+// state following a restart.
+type ArbitratorState uint8
+
+const (
+	// StateDefault is the default state. In this state, no major
+	// actions need to be executed.
+	StateDefault ArbitratorState = 0
+
+	// StateBroadcastCommit is the state that's transitioned to once the
+	// channel has been forced closed, either by us, or the remote party.
+	// In this state, we'll broadcast our current commitment transaction,
+	// and then execute the necessary actions to resolve all pending
+	// contracts.
+	StateBroadcastCommit ArbitratorState = 1
+
+	// StateCommitmentBroadcasted is the state that's transitioned to
+	// once our commitment transaction has been broadcast. In this state,
+	// we'll wait for the commitment to confirm, and accordingly transition
+	// to the next state upon confirmation.
+	StateCommitmentBroadcasted ArbitratorState = 2
+
+	// StateAnchorSweepPending is the state that's transitioned to once
+	// our own commitment has been broadcast, but hasn't yet confirmed,
+	// and the commitment carries a local anchor output. In this state,
+	// the arbitrator is responsible for CPFP'ing the anchor output as
+	// needed in order to get the commitment confirmed in time to claim
+	// any outstanding HTLC's.
+	StateAnchorSweepPending ArbitratorState = 3
+
+	// StateContractClosed is the state that's transitioned to once the
+	// on-chain closing event (either cooperative or unilateral) has been
+	// confirmed on-chain. In this state, we'll extract all the necessary
+	// resolutions and launch their corresponding resolvers.
+	StateContractClosed ArbitratorState = 4
+
+	// StateWaitingFullResolution is the state that's transitioned to
+	// once we've launched all the resolvers for a contract and are
+	// simply waiting for them all to be fully resolved.
+	StateWaitingFullResolution ArbitratorState = 5
+
+	// StateFullyResolved is the final state for the channel arbitrator.
+	// Once in this state, it indicates that all contracts have been
+	// fully resolved, and the channel arbitrator can be torn down.
+	StateFullyResolved ArbitratorState = 6
+)
+
+// String returns a human readable string describing the ArbitratorState.
+func (a ArbitratorState) String() string {
+	switch a {
+	case StateDefault:
+		return "StateDefault"
+	case StateBroadcastCommit:
+		return "StateBroadcastCommit"
+	case StateCommitmentBroadcasted:
+		return "StateCommitmentBroadcasted"
+	case StateAnchorSweepPending:
+		return "StateAnchorSweepPending"
+	case StateContractClosed:
+		return "StateContractClosed"
+	case StateWaitingFullResolution:
+		return "StateWaitingFullResolution"
+	case StateFullyResolved:
+		return "StateFullyResolved"
+	default:
+		return "unknown state"
+	}
+}
+
+// ContractResolutions is a complete set of contract resolutions that are
+// extracted once the channel's closing transaction has been confirmed. This
+// struct will carry all the information necessary to resolve all contracts
+// that were active at the time of the channel's closure.
+type ContractResolutions struct {
+	// CommitHash is the txid of the transaction that confirmed the
+	// channel's closure.
+	CommitHash chainhash.Hash
+
+	// CommitResolution contains all data required to fully resolve our
+	// commitment output, if it exists.
+	CommitResolution *lnwallet.CommitOutputResolution
+
+	// HtlcResolutions contains all data required to fully resolve any
+	// incoming or outgoing HTLC's present within the commitment
+	// transaction.
+	HtlcResolutions *lnwallet.HtlcResolutions
+}
+
+// ChainAction is an enum that represents the action that the
+// ChannelArbitrator should take for a given HTLC once a channel has been
+// closed.
+type ChainAction uint8
+
+const (
+	// HtlcTimeoutAction indicates that the HTLC will be timed out by
+	// broadcasting the second-level timeout transaction.
+	HtlcTimeoutAction ChainAction = iota
+
+	// HtlcClaimAction indicates that the HTLC should be claimed by
+	// revealing the preimage on chain.
+	HtlcClaimAction
+
+	// HtlcFailNowAction indicates that the HTLC should be failed back
+	// immediately, as it's not possible for it to be claimed on chain.
+	HtlcFailNowAction
+
+	// HtlcIncomingWatchAction indicates that we don't yet need to take
+	// action on this incoming HTLC, but we should continue to watch it.
+	HtlcIncomingWatchAction
+
+	// HtlcOutgoingWatchAction indicates that we don't yet need to take
+	// action on this outgoing HTLC, but we should continue to watch it.
+	HtlcOutgoingWatchAction
+)
+
+// ChainActionMap is a map of a chain action, to the set of HTLC's that need
+// to be acted upon for a given action type.
+type ChainActionMap map[ChainAction][]channeldb.HTLC
+
+// LogTx is the set of mutating log operations that can be grouped together
+// and applied as a single atomic unit of work via ArbitratorLog.Update, so
+// that a state transition is never persisted without its associated
+// resolutions or chain actions, or vice versa.
+type LogTx interface {
+	// CommitState persists, the current state of the chain attendant.
+	CommitState(ArbitratorState) error
+
+	// LogContractResolutions stores a complete contract resolution for
+	// the contract under watch. This method will be called once the
+	// channel is closed, before the individual contracts are resolved.
+	LogContractResolutions(c *ContractResolutions) error
+
+	// LogChainActions stores a set of chain actions which are derived
+	// from our set of HTLC's, and the state of the chain.
+	LogChainActions(actions ChainActionMap) error
+
+	// InsertUnresolvedContracts inserts a set of unresolved contracts
+	// into the log. The log will then persist these contracts until
+	// they've been swapped out for a new one, or are signalled as fully
+	// resolved.
+	InsertUnresolvedContracts(resolvers ...ContractResolver) error
+}
+
+// ArbitratorLog is the persistent storage layer for the ChannelArbitrator.
+// This interface is used by the ChannelArbitrator to log its internal state
+// transitions, as well as the resolutions and chain actions it decides upon
+// so they may be re-derived after a restart.
+type ArbitratorLog interface {
+	// CurrentState returns the current state of the ChannelArbitrator.
+	CurrentState() (ArbitratorState, error)
+
+	// Update applies the set of log operations performed by the update
+	// closure as a single atomic transaction. If the closure returns a
+	// non-nil error, none of the operations it performed are persisted,
+	// so a restart following a failed Update resumes from the state that
+	// was current immediately before the call.
+	Update(update func(tx LogTx) error) error
+
+	// FetchUnresolvedContracts returns all unresolved contracts that the
+	// resolver may need to act on.
+	FetchUnresolvedContracts() ([]ContractResolver, error)
+
+	// SwapContract performs an atomic swap of the old contract for the
+	// new contract. This is used when a contract is replaced with a new
+	// resolver once it's partially resolved.
+	SwapContract(oldContract, newContract ContractResolver) error
+
+	// ResolveContract marks a contract as fully resolved. Once a
+	// contract has been fully resolved, it is deleted from persistent
+	// storage.
+	ResolveContract(res ContractResolver) error
+
+	// FetchContractResolutions fetches the set of contract resolutions
+	// that was stored by the ChannelArbitrator in the past.
+	FetchContractResolutions() (*ContractResolutions, error)
+
+	// FetchChainActions attempts to fetch the set of previously stored
+	// chain actions. This method should only be called once the
+	// resolver has logged its state transition from pending to
+	// confirmed.
+	FetchChainActions() (ChainActionMap, error)
+
+	// WipeHistory wipes all persisted state within the log.
+	WipeHistory() error
+}
@@ -0,0 +1,23 @@
+package contractcourt
+
+import "github.com/btcsuite/btclog"
+
+// log is the logger used by the contractcourt package. It is set via
+// UseLogger below, and defaults to a no-op logger until the caller does so.
+var log btclog.Logger
+
+// The default amount of logging is none.
+func init() {
+	UseLogger(btclog.Disabled)
+}
+
+// DisableLog disables all library log output. Logging output is disabled by
+// default until UseLogger is called.
+func DisableLog() {
+	UseLogger(btclog.Disabled)
+}
+
+// UseLogger uses a specified Logger to output package logging info.
+func UseLogger(logger btclog.Logger) {
+	log = logger
+}